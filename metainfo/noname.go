@@ -0,0 +1,10 @@
+package metainfo
+
+// NoName is a sentinel value for Info.Name. Storage implementations that
+// understand it omit the name component entirely when laying out a
+// torrent's files, placing them directly under the torrent's directory
+// instead of wrapping them in a subdirectory. This mirrors a convention
+// used by Transmission for torrents that intentionally have no such
+// wrapper, and is also useful as an escape hatch for infos whose Name
+// isn't safe to use as a path component.
+const NoName = "\x00"
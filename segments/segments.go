@@ -0,0 +1,66 @@
+// Package segments provides an index over a sequence of consecutive,
+// non-overlapping extents (such as the files of a torrent laid end to end),
+// allowing the segment(s) touched by an arbitrary extent to be located in
+// O(log n) rather than by scanning every segment.
+package segments
+
+import "sort"
+
+// Extent is a half-open interval [Start, Start+Length).
+type Extent struct {
+	Start, Length int64
+}
+
+// End returns the exclusive end of the extent.
+func (e Extent) End() int64 {
+	return e.Start + e.Length
+}
+
+// Index is a sorted list of consecutive segment extents.
+type Index []Extent
+
+// NewIndex builds an Index from the lengths of consecutive segments,
+// computing each segment's start as the sum of the lengths before it.
+func NewIndex(lens []int64) Index {
+	idx := make(Index, len(lens))
+	var off int64
+	for i, l := range lens {
+		idx[i] = Extent{Start: off, Length: l}
+		off += l
+	}
+	return idx
+}
+
+// Locate finds the segments overlapping e, walking forward from the first
+// one found by binary search. For each overlapping segment i, callback is
+// invoked with the portion of e that falls within it, expressed relative
+// to that segment's own start (so e.Start == 0 refers to the first byte of
+// the segment). Locate stops early if callback returns false.
+func (idx Index) Locate(e Extent, callback func(i int, e Extent) bool) {
+	if e.Length <= 0 {
+		return
+	}
+	n := len(idx)
+	i := sort.Search(n, func(i int) bool {
+		return idx[i].End() > e.Start
+	})
+	off := e.Start
+	remaining := e.Length
+	for ; i < n && remaining > 0; i++ {
+		seg := idx[i]
+		segOff := off - seg.Start
+		avail := seg.Length - segOff
+		if avail <= 0 {
+			continue
+		}
+		take := avail
+		if take > remaining {
+			take = remaining
+		}
+		if !callback(i, Extent{Start: segOff, Length: take}) {
+			return
+		}
+		off += take
+		remaining -= take
+	}
+}
@@ -0,0 +1,63 @@
+package segments
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIndexLocate(t *testing.T) {
+	idx := NewIndex([]int64{10, 0, 20, 5})
+	type hit struct {
+		i int
+		e Extent
+	}
+	locate := func(e Extent) (hits []hit) {
+		idx.Locate(e, func(i int, e Extent) bool {
+			hits = append(hits, hit{i, e})
+			return true
+		})
+		return
+	}
+
+	if got := locate(Extent{0, 10}); !reflect.DeepEqual(got, []hit{{0, Extent{0, 10}}}) {
+		t.Errorf("got %v", got)
+	}
+	if got := locate(Extent{5, 30}); !reflect.DeepEqual(got, []hit{
+		{0, Extent{5, 5}},
+		{2, Extent{0, 20}},
+		{3, Extent{0, 5}},
+	}) {
+		t.Errorf("got %v", got)
+	}
+	if got := locate(Extent{35, 0}); len(got) != 0 {
+		t.Errorf("zero-length extent should not match anything, got %v", got)
+	}
+	if got := locate(Extent{34, 5}); !reflect.DeepEqual(got, []hit{{3, Extent{4, 1}}}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestIndexLocateStopsEarly(t *testing.T) {
+	idx := NewIndex([]int64{10, 10, 10})
+	var seen []int
+	idx.Locate(Extent{0, 30}, func(i int, e Extent) bool {
+		seen = append(seen, i)
+		return i < 1
+	})
+	if !reflect.DeepEqual(seen, []int{0, 1}) {
+		t.Errorf("got %v", seen)
+	}
+}
+
+func BenchmarkIndexLocate(b *testing.B) {
+	lens := make([]int64, 10000)
+	for i := range lens {
+		lens[i] = 1 << 20
+	}
+	idx := NewIndex(lens)
+	e := Extent{Start: int64(len(lens)/2) << 20, Length: 3 << 20}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.Locate(e, func(int, Extent) bool { return true })
+	}
+}
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxOpenReadFDs  = 100
+	defaultMaxOpenWriteFDs = 20
+	defaultFDIdleTimeout   = 10 * time.Second
+)
+
+// fileHandle is a single cached, open file handle. It carries its own
+// mutex so that concurrent operations on distinct files don't serialize
+// behind the cache's lock.
+type fileHandle struct {
+	mu       sync.Mutex
+	path     string
+	f        *os.File
+	lastUsed time.Time
+	elem     *list.Element
+
+	cache *fdCache
+	// refs is the number of callers currently holding this handle, i.e.
+	// the count of get() calls not yet matched by a release(). refs is
+	// protected by cache.mu, not mu: it guards against eviction, not
+	// against concurrent I/O. While refs > 0, neither size-based nor idle
+	// eviction closes f; fdCache.close closes it regardless.
+	refs int
+}
+
+// release returns the handle to its cache, allowing it to be evicted once
+// nothing else holds it. Every successful fdCache.get must be matched by
+// exactly one release.
+func (h *fileHandle) release() {
+	h.cache.put(h)
+}
+
+// fdCache is a bounded, time-expiring cache of open *os.File handles keyed
+// by absolute path. It exists so a torrent with tens of thousands of files
+// doesn't hold an FD open for every file for its entire lifetime. Entries
+// idle for longer than idleTimeout are closed by a background goroutine;
+// entries beyond maxOpen are evicted least-recently-used first, skipping
+// any handle a caller currently holds (see fileHandle.refs).
+type fdCache struct {
+	mu          sync.Mutex
+	entries     map[string]*fileHandle
+	lru         *list.List // of *fileHandle, front = most recently used
+	maxOpen     int
+	idleTimeout time.Duration
+	open        func(path string) (*os.File, error)
+
+	cleanOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFDCache(maxOpen int, idleTimeout time.Duration, open func(path string) (*os.File, error)) *fdCache {
+	return &fdCache{
+		entries:     make(map[string]*fileHandle),
+		lru:         list.New(),
+		maxOpen:     maxOpen,
+		idleTimeout: idleTimeout,
+		open:        open,
+		closed:      make(chan struct{}),
+	}
+}
+
+// get returns the cached handle for path, opening it via c.open if it's
+// not already cached. The returned handle is pinned against eviction until
+// its release method is called.
+func (c *fdCache) get(path string) (*fileHandle, error) {
+	c.cleanOnce.Do(c.startCleaner)
+
+	c.mu.Lock()
+	if h, ok := c.entries[path]; ok {
+		c.acquireLocked(h)
+		c.mu.Unlock()
+		return h, nil
+	}
+	c.mu.Unlock()
+
+	f, err := c.open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if h, ok := c.entries[path]; ok {
+		// Lost a race to open the same path concurrently; use the
+		// winner's handle and close the one we just opened.
+		c.acquireLocked(h)
+		c.mu.Unlock()
+		f.Close()
+		return h, nil
+	}
+	h := &fileHandle{path: path, f: f, lastUsed: time.Now(), cache: c, refs: 1}
+	h.elem = c.lru.PushFront(h)
+	c.entries[path] = h
+	victims := c.evictLocked()
+	c.mu.Unlock()
+	closeHandles(victims)
+	return h, nil
+}
+
+// acquireLocked pins h and marks it recently used. c.mu must be held.
+func (c *fdCache) acquireLocked(h *fileHandle) {
+	h.refs++
+	h.lastUsed = time.Now()
+	c.lru.MoveToFront(h.elem)
+}
+
+// put releases a pin taken by get. Once a handle's ref count drops to
+// zero it becomes eligible for eviction again.
+func (c *fdCache) put(h *fileHandle) {
+	c.mu.Lock()
+	h.refs--
+	var victims []*fileHandle
+	if h.refs == 0 {
+		victims = c.evictLocked()
+	}
+	c.mu.Unlock()
+	closeHandles(victims)
+}
+
+// evictLocked detaches (but does not close) least-recently-used,
+// unpinned entries beyond maxOpen, returning them for the caller to close
+// once c.mu is released. c.mu must be held.
+func (c *fdCache) evictLocked() (victims []*fileHandle) {
+	if c.maxOpen <= 0 {
+		return nil
+	}
+	for elem := c.lru.Back(); elem != nil && len(c.entries) > c.maxOpen; {
+		h := elem.Value.(*fileHandle)
+		prev := elem.Prev()
+		if h.refs > 0 {
+			elem = prev
+			continue
+		}
+		c.lru.Remove(elem)
+		delete(c.entries, h.path)
+		victims = append(victims, h)
+		elem = prev
+	}
+	return
+}
+
+func (c *fdCache) startCleaner() {
+	go func() {
+		ticker := time.NewTicker(c.idleTimeout)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.closeIdle()
+			case <-c.closed:
+				return
+			}
+		}
+	}()
+}
+
+// closeIdle detaches and closes handles that haven't been used for longer
+// than idleTimeout and aren't currently pinned.
+func (c *fdCache) closeIdle() {
+	c.mu.Lock()
+	cutoff := time.Now().Add(-c.idleTimeout)
+	var victims []*fileHandle
+	for elem := c.lru.Back(); elem != nil; {
+		h := elem.Value.(*fileHandle)
+		prev := elem.Prev()
+		if h.lastUsed.After(cutoff) {
+			break
+		}
+		if h.refs > 0 {
+			elem = prev
+			continue
+		}
+		c.lru.Remove(elem)
+		delete(c.entries, h.path)
+		victims = append(victims, h)
+		elem = prev
+	}
+	c.mu.Unlock()
+	closeHandles(victims)
+}
+
+// close closes every cached handle and stops the idle-eviction goroutine.
+// The cache must not be used afterwards.
+func (c *fdCache) close() {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	c.mu.Lock()
+	victims := make([]*fileHandle, 0, len(c.entries))
+	for _, h := range c.entries {
+		victims = append(victims, h)
+	}
+	c.entries = make(map[string]*fileHandle)
+	c.lru = list.New()
+	c.mu.Unlock()
+	closeHandles(victims)
+}
+
+// closeHandles closes each handle's file, serializing against any
+// in-progress I/O on it via its own mutex.
+func closeHandles(hs []*fileHandle) {
+	for _, h := range hs {
+		h.mu.Lock()
+		h.f.Close()
+		h.mu.Unlock()
+	}
+}
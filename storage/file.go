@@ -1,25 +1,70 @@
 package storage
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"sync"
+	"time"
 
 	"github.com/anacrolix/missinggo"
 
 	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/segments"
 )
 
 // File-based storage for torrents, that isn't yet bound to a particular
 // torrent.
 type fileClientImpl struct {
-	baseDir   string
-	pathMaker func(baseDir string, info *metainfo.Info, infoHash metainfo.Hash) string
-	pc        PieceCompletion
+	opts NewFileClientOpts
 }
 
-// The Default path maker just returns the current path
+// TorrentDirFilePathMaker determines the directory a torrent's files are
+// stored under, given the client's base directory.
+type TorrentDirFilePathMaker func(baseDir string, info *metainfo.Info, infoHash metainfo.Hash) string
+
+// FilePathMakerOpts carries everything needed to compute the on-disk path
+// of a single file belonging to a torrent.
+type FilePathMakerOpts struct {
+	Info     *metainfo.Info
+	InfoHash metainfo.Hash
+	File     metainfo.FileInfo
+}
+
+// FilePathMaker computes the path of a file relative to its torrent's
+// directory (as produced by a TorrentDirFilePathMaker). Implementations
+// can flatten multi-file torrents, remap by extension, place large files
+// on a separate volume, or strip the info.Name directory entirely.
+type FilePathMaker func(opts FilePathMakerOpts) string
+
+// NewFileClientOpts bundles the configuration accepted by NewFileOpts.
+type NewFileClientOpts struct {
+	// ClientBaseDir is the directory all torrent data is stored under,
+	// unless TorrentDirMaker relocates a particular torrent elsewhere.
+	ClientBaseDir string
+	// TorrentDirMaker determines a torrent's directory. Defaults to always
+	// returning ClientBaseDir.
+	TorrentDirMaker TorrentDirFilePathMaker
+	// FilePathMaker determines the path of each file within the torrent's
+	// directory. Defaults to preserving info.Name and the file's Path.
+	FilePathMaker FilePathMaker
+	// PieceCompletion records which pieces have been written. Defaults to
+	// the standard on-disk completion store for ClientBaseDir.
+	PieceCompletion PieceCompletion
+	// MaxOpenReadFDs caps how many read-only file handles are kept open at
+	// once, across all files of a torrent. Defaults to
+	// defaultMaxOpenReadFDs.
+	MaxOpenReadFDs int
+	// MaxOpenWriteFDs caps how many writable file handles are kept open at
+	// once. Defaults to defaultMaxOpenWriteFDs.
+	MaxOpenWriteFDs int
+	// IdleTimeout is how long a file handle may sit unused before it's
+	// closed by the idle-eviction goroutine. Defaults to
+	// defaultFDIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+// The default TorrentDirFilePathMaker just returns the client's base dir.
 func defaultPathMaker(baseDir string, info *metainfo.Info, infoHash metainfo.Hash) string {
 	return baseDir
 }
@@ -28,6 +73,27 @@ func infoHashPathMaker(baseDir string, info *metainfo.Info, infoHash metainfo.Ha
 	return filepath.Join(baseDir, infoHash.HexString())
 }
 
+// defaultFilePathMaker preserves the historical layout: the torrent's
+// info.Name followed by the file's own Path components. If Info.Name is
+// metainfo.NoName, the name component is omitted entirely, laying files
+// directly under the torrent's directory.
+func defaultFilePathMaker(opts FilePathMakerOpts) string {
+	if opts.Info.Name == metainfo.NoName {
+		return filepath.Join(opts.File.Path...)
+	}
+	return filepath.Join(append([]string{opts.Info.Name}, opts.File.Path...)...)
+}
+
+// safeNameComponent returns info.Name as passed to ToSafeFilePath, treating
+// metainfo.NoName as the absence of a name component rather than as an
+// unsafe path segment.
+func safeNameComponent(info *metainfo.Info) string {
+	if info.Name == metainfo.NoName {
+		return ""
+	}
+	return info.Name
+}
+
 // All Torrent data stored in this baseDir
 func NewFile(baseDir string) ClientImpl {
 	return NewFileWithCompletion(baseDir, pieceCompletionForDir(baseDir))
@@ -43,46 +109,103 @@ func NewFileByInfoHash(baseDir string) ClientImpl {
 }
 
 // Allows passing a function to determine the path for storing torrent data
-func NewFileWithCustomPathMaker(baseDir string, pathMaker func(baseDir string, info *metainfo.Info, infoHash metainfo.Hash) string) ClientImpl {
+func NewFileWithCustomPathMaker(baseDir string, pathMaker TorrentDirFilePathMaker) ClientImpl {
 	return newFileWithCustomPathMakerAndCompletion(baseDir, pathMaker, pieceCompletionForDir(baseDir))
 }
 
-func newFileWithCustomPathMakerAndCompletion(baseDir string, pathMaker func(baseDir string, info *metainfo.Info, infoHash metainfo.Hash) string, completion PieceCompletion) ClientImpl {
-	if pathMaker == nil {
-		pathMaker = defaultPathMaker
+func newFileWithCustomPathMakerAndCompletion(baseDir string, pathMaker TorrentDirFilePathMaker, completion PieceCompletion) ClientImpl {
+	return NewFileOpts(NewFileClientOpts{
+		ClientBaseDir:   baseDir,
+		TorrentDirMaker: pathMaker,
+		PieceCompletion: completion,
+	})
+}
+
+// NewFileOpts creates a file-based ClientImpl with full control over how
+// torrent directories and individual file paths are derived. See
+// NewFileClientOpts and FilePathMaker.
+func NewFileOpts(opts NewFileClientOpts) ClientImpl {
+	if opts.TorrentDirMaker == nil {
+		opts.TorrentDirMaker = defaultPathMaker
+	}
+	if opts.FilePathMaker == nil {
+		opts.FilePathMaker = defaultFilePathMaker
+	}
+	if opts.PieceCompletion == nil {
+		opts.PieceCompletion = pieceCompletionForDir(opts.ClientBaseDir)
 	}
-	return &fileClientImpl{
-		baseDir:   baseDir,
-		pathMaker: pathMaker,
-		pc:        completion,
+	if opts.MaxOpenReadFDs == 0 {
+		opts.MaxOpenReadFDs = defaultMaxOpenReadFDs
 	}
+	if opts.MaxOpenWriteFDs == 0 {
+		opts.MaxOpenWriteFDs = defaultMaxOpenWriteFDs
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = defaultFDIdleTimeout
+	}
+	return &fileClientImpl{opts}
 }
 
 func (me *fileClientImpl) Close() error {
-	return me.pc.Close()
+	return me.opts.PieceCompletion.Close()
 }
 
 func (fs *fileClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (TorrentImpl, error) {
-	dir := fs.pathMaker(fs.baseDir, info, infoHash)
-	err := CreateNativeZeroLengthFiles(info, dir)
+	for _, fi := range info.UpvertedFiles() {
+		if _, err := ToSafeFilePath(safeNameComponent(info), fi.Path...); err != nil {
+			return nil, fmt.Errorf("unsafe file path in torrent info: %w", err)
+		}
+		rel := fs.opts.FilePathMaker(FilePathMakerOpts{Info: info, InfoHash: infoHash, File: fi})
+		if rel == "" {
+			return nil, fmt.Errorf("file path for %v resolves to the torrent directory itself", fi.Path)
+		}
+		if err := validateRelPath(rel); err != nil {
+			return nil, fmt.Errorf("unsafe file path for %v: %w", fi.Path, err)
+		}
+	}
+	dir := fs.opts.TorrentDirMaker(fs.opts.ClientBaseDir, info, infoHash)
+	err := CreateNativeZeroLengthFiles(info, dir, fs.opts.FilePathMaker, infoHash)
 	if err != nil {
 		return nil, err
 	}
-	return &fileTorrentImpl{
+	upvertedFiles := info.UpvertedFiles()
+	lens := make([]int64, len(upvertedFiles))
+	for i, fi := range upvertedFiles {
+		lens[i] = fi.Length
+	}
+	fts := &fileTorrentImpl{
 		dir,
 		info,
 		infoHash,
-		fs.pc,
-		map[string]*fileTorrentHandle{},
-	}, nil
+		fs.opts.PieceCompletion,
+		fs.opts.FilePathMaker,
+		segments.NewIndex(lens),
+		nil,
+		nil,
+		newMkdirCache(),
+	}
+	fts.readFDs = newFDCache(fs.opts.MaxOpenReadFDs, fs.opts.IdleTimeout, func(path string) (*os.File, error) {
+		return os.OpenFile(path, os.O_RDONLY, 0)
+	})
+	fts.writeFDs = newFDCache(fs.opts.MaxOpenWriteFDs, fs.opts.IdleTimeout, func(path string) (*os.File, error) {
+		if err := fts.mkdirs.ensure(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+		return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	})
+	return fts, nil
 }
 
 type fileTorrentImpl struct {
-	dir        string
-	info       *metainfo.Info
-	infoHash   metainfo.Hash
-	completion PieceCompletion
-	handles    map[string]*fileTorrentHandle
+	dir           string
+	info          *metainfo.Info
+	infoHash      metainfo.Hash
+	completion    PieceCompletion
+	filePathMaker FilePathMaker
+	segmentsIndex segments.Index
+	readFDs       *fdCache
+	writeFDs      *fdCache
+	mkdirs        *mkdirCache
 }
 
 func (fts *fileTorrentImpl) Piece(p metainfo.Piece) PieceImpl {
@@ -97,49 +220,56 @@ func (fts *fileTorrentImpl) Piece(p metainfo.Piece) PieceImpl {
 	}
 }
 
-func (fs *fileTorrentImpl) OpenFile(fi metainfo.FileInfo, creatable bool) (*fileTorrentHandle, error) {
-	filename := fs.fileInfoName(fi)
-	if h, ok := fs.handles[filename]; ok {
-		return h, nil
+func (fs *fileTorrentImpl) OpenFile(fi metainfo.FileInfo, creatable bool) (*fileHandle, error) {
+	filename, err := fs.fileInfoName(fi)
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err := os.Stat(filename); os.IsNotExist(err) && !creatable {
-		return nil, io.EOF
+	if creatable {
+		return fs.writeFDs.get(filename)
 	}
 
-	os.MkdirAll(filepath.Dir(filename), 0770)
-	f, err := os.OpenFile(filename, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0660)
-	if err != nil {
-		return nil, err
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil, io.EOF
 	}
-
-	fs.handles[filename] = &fileTorrentHandle{f, filename, &sync.Mutex{}}
-	return fs.handles[filename], nil
+	return fs.readFDs.get(filename)
 }
 
 func (fs *fileTorrentImpl) Close() error {
-	for _, h := range fs.handles {
-		if h != nil && h.f != nil {
-			err := h.f.Close()
-			if err != nil {
-				return err
-			}
-		}
-	}
-
+	fs.readFDs.close()
+	fs.writeFDs.close()
 	return nil
 }
 
 // CreateNativeZeroLengthFiles Creates natives files for any zero-length file
 // entries in the info. This is a helper for file-based storages, which
 // don't address or write to zero-length files because they have
-// no corresponding pieces.
-func CreateNativeZeroLengthFiles(info *metainfo.Info, dir string) (err error) {
+// no corresponding pieces. fpm determines the path of each file within
+// dir; pass nil to use the default layout.
+func CreateNativeZeroLengthFiles(info *metainfo.Info, dir string, fpm FilePathMaker, infoHash metainfo.Hash) (err error) {
+	if fpm == nil {
+		fpm = defaultFilePathMaker
+	}
 	for _, fi := range info.UpvertedFiles() {
 		if fi.Length != 0 {
 			continue
 		}
-		name := filepath.Join(append([]string{dir, info.Name}, fi.Path...)...)
+		if _, err = ToSafeFilePath(safeNameComponent(info), fi.Path...); err != nil {
+			return
+		}
+		rel := fpm(FilePathMakerOpts{
+			Info:     info,
+			InfoHash: infoHash,
+			File:     fi,
+		})
+		if rel == "" {
+			return fmt.Errorf("file path for %v resolves to the torrent directory itself", fi.Path)
+		}
+		if err = validateRelPath(rel); err != nil {
+			return fmt.Errorf("unsafe file path for %v: %w", fi.Path, err)
+		}
+		name := filepath.Join(dir, rel)
 		os.MkdirAll(filepath.Dir(name), 0770)
 		var f *os.File
 		f, err = os.Create(name)
@@ -158,11 +288,12 @@ type fileTorrentImplIO struct {
 
 // Returns EOF on short or missing file.
 func (fst *fileTorrentImplIO) readFileAt(fi metainfo.FileInfo, b []byte, off int64) (n int, err error) {
-	var h *fileTorrentHandle
+	var h *fileHandle
 	h, err = fst.fts.OpenFile(fi, false)
 	if err != nil {
 		return
 	}
+	defer h.release()
 
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -186,71 +317,86 @@ func (fst *fileTorrentImplIO) readFileAt(fi metainfo.FileInfo, b []byte, off int
 
 // Only returns EOF at the end of the torrent. Premature EOF is ErrUnexpectedEOF.
 func (fst fileTorrentImplIO) ReadAt(b []byte, off int64) (n int, err error) {
-	for _, fi := range fst.fts.info.UpvertedFiles() {
-		for off < fi.Length {
-			n1, err1 := fst.readFileAt(fi, b, off)
-			n += n1
-			off += int64(n1)
-			b = b[n1:]
-			if len(b) == 0 {
-				// Got what we need.
-				return
-			}
-			if n1 != 0 {
-				// Made progress.
-				continue
-			}
-			err = err1
-			if err == io.EOF {
-				// Lies.
-				err = io.ErrUnexpectedEOF
-			}
-			return
+	files := fst.fts.info.UpvertedFiles()
+	fst.fts.segmentsIndex.Locate(segments.Extent{Start: off, Length: int64(len(b))}, func(i int, e segments.Extent) bool {
+		var n1 int
+		var err1 error
+		n1, err1 = fst.readFileAt(files[i], b[:e.Length], e.Start)
+		n += n1
+		b = b[n1:]
+		if int64(n1) == e.Length {
+			// Made progress through this segment.
+			return true
+		}
+		err = err1
+		if err == io.EOF {
+			// Lies: we haven't reached the end of the torrent yet.
+			err = io.ErrUnexpectedEOF
 		}
-		off -= fi.Length
+		return false
+	})
+	if len(b) == 0 {
+		err = nil
+	} else if err == nil {
+		// Ran off the end of the index without filling b.
+		err = io.EOF
 	}
-	err = io.EOF
 	return
 }
 
 func (fst fileTorrentImplIO) WriteAt(p []byte, off int64) (n int, err error) {
-	for _, fi := range fst.fts.info.UpvertedFiles() {
-		if off >= fi.Length {
-			off -= fi.Length
-			continue
-		}
-		n1 := len(p)
-		if int64(n1) > fi.Length-off {
-			n1 = int(fi.Length - off)
-		}
-		var h *fileTorrentHandle
-		h, err = fst.fts.OpenFile(fi, true)
+	files := fst.fts.info.UpvertedFiles()
+	fst.fts.segmentsIndex.Locate(segments.Extent{Start: off, Length: int64(len(p))}, func(i int, e segments.Extent) bool {
+		var h *fileHandle
+		h, err = fst.fts.OpenFile(files[i], true)
 		if err != nil {
-			return
+			return false
 		}
+		defer h.release()
 		h.mu.Lock()
-		n1, err = h.f.WriteAt(p[:n1], off)
+		var n1 int
+		n1, err = h.f.WriteAt(p[:e.Length], e.Start)
 		// TODO: On some systems, write errors can be delayed until the Close.
 		h.mu.Unlock()
-		if err != nil {
-			return
-		}
 		n += n1
-		off = 0
 		p = p[n1:]
-		if len(p) == 0 {
-			break
-		}
-	}
+		return err == nil
+	})
 	return
 }
 
-func (fts *fileTorrentImpl) fileInfoName(fi metainfo.FileInfo) string {
-	return filepath.Join(append([]string{fts.dir, fts.info.Name}, fi.Path...)...)
+// extentCompleteRequiredLengths returns, for each file touched by the
+// extent [off, off+length), a copy of its metainfo.FileInfo with Length
+// reduced to the minimum on-disk size required to contain its portion of
+// the extent. This lets completion checks verify just enough of each file
+// without scanning every file in the torrent.
+func (fts *fileTorrentImpl) extentCompleteRequiredLengths(off, length int64) (ret []metainfo.FileInfo) {
+	files := fts.info.UpvertedFiles()
+	fts.segmentsIndex.Locate(segments.Extent{Start: off, Length: length}, func(i int, e segments.Extent) bool {
+		fi := files[i]
+		if required := e.Start + e.Length; required < fi.Length {
+			fi.Length = required
+		}
+		ret = append(ret, fi)
+		return true
+	})
+	return
 }
 
-type fileTorrentHandle struct {
-	f    *os.File
-	path string
-	mu   *sync.Mutex
+func (fts *fileTorrentImpl) fileInfoName(fi metainfo.FileInfo) (string, error) {
+	if _, err := ToSafeFilePath(safeNameComponent(fts.info), fi.Path...); err != nil {
+		return "", err
+	}
+	rel := fts.filePathMaker(FilePathMakerOpts{
+		Info:     fts.info,
+		InfoHash: fts.infoHash,
+		File:     fi,
+	})
+	if rel == "" {
+		return "", fmt.Errorf("file path for %v resolves to the torrent directory itself", fi.Path)
+	}
+	if err := validateRelPath(rel); err != nil {
+		return "", fmt.Errorf("unsafe file path for %v: %w", fi.Path, err)
+	}
+	return filepath.Join(fts.dir, rel), nil
 }
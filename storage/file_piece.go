@@ -29,7 +29,7 @@ func (fs *filePieceImpl) Completion() Completion {
 	}
 	// If it's allegedly complete, check that its constituent files have the
 	// necessary length.
-	for _, fi := range extentCompleteRequiredLengths(fs.p.Info, fs.p.Offset(), fs.p.Length()) {
+	for _, fi := range fs.fileTorrentImpl.extentCompleteRequiredLengths(fs.p.Offset(), fs.p.Length()) {
 		h, errOpen := fs.fileTorrentImpl.OpenFile(fi, false)
 		if errOpen != nil {
 			c.Complete = false
@@ -39,6 +39,7 @@ func (fs *filePieceImpl) Completion() Completion {
 		h.mu.Lock()
 		s, err := h.f.Stat()
 		h.mu.Unlock()
+		h.release()
 
 		if err != nil || s == nil || s.Size() < fi.Length {
 			c.Complete = false
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func newTestFileTorrent(t testing.TB, info *metainfo.Info) (*fileTorrentImpl, ClientImpl) {
+	ci := NewFile(t.TempDir())
+	ti, err := ci.OpenTorrent(info, metainfo.Hash{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ti.(*fileTorrentImpl), ci
+}
+
+func multiFileInfo(fileLengths ...int64) *metainfo.Info {
+	info := &metainfo.Info{Name: "torrent"}
+	for i, l := range fileLengths {
+		info.Files = append(info.Files, metainfo.FileInfo{
+			Length: l,
+			Path:   []string{fmt.Sprintf("file%d", i)},
+		})
+	}
+	return info
+}
+
+func TestFileReadWriteAtRoundTrip(t *testing.T) {
+	info := multiFileInfo(3, 0, 5, 2)
+	fts, ci := newTestFileTorrent(t, info)
+	defer ci.Close()
+	defer fts.Close()
+
+	io_ := fileTorrentImplIO{fts}
+	want := []byte("hello!")
+	if n, err := io_.WriteAt(want, 2); err != nil || n != len(want) {
+		t.Fatalf("WriteAt: n=%d err=%v", n, err)
+	}
+	got := make([]byte, len(want))
+	if n, err := io_.ReadAt(got, 2); err != nil || n != len(got) {
+		t.Fatalf("ReadAt: n=%d err=%v", n, err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestFileReadAtPrematureEOF(t *testing.T) {
+	info := multiFileInfo(10)
+	fts, ci := newTestFileTorrent(t, info)
+	defer ci.Close()
+	defer fts.Close()
+
+	// Create the file with fewer bytes than the info claims.
+	name, err := fts.fileInfoName(info.UpvertedFiles()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0770); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte("short"), 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	io_ := fileTorrentImplIO{fts}
+	b := make([]byte, 10)
+	_, err = io_.ReadAt(b, 0)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestFileReadAtRunsOffEnd(t *testing.T) {
+	info := multiFileInfo(4)
+	fts, ci := newTestFileTorrent(t, info)
+	defer ci.Close()
+	defer fts.Close()
+
+	io_ := fileTorrentImplIO{fts}
+	if _, err := io_.WriteAt([]byte("abcd"), 0); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 8)
+	_, err := io_.ReadAt(b, 0)
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestOpenTorrentRejectsEscapingFilePathMaker(t *testing.T) {
+	info := multiFileInfo(4)
+	ci := NewFileOpts(NewFileClientOpts{
+		ClientBaseDir: t.TempDir(),
+		FilePathMaker: func(opts FilePathMakerOpts) string {
+			return filepath.Join("..", "evil")
+		},
+	})
+	defer ci.Close()
+	if _, err := ci.OpenTorrent(info, metainfo.Hash{}); err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+}
+
+func BenchmarkReadAtManyFiles(b *testing.B) {
+	const numFiles = 10000
+	lens := make([]int64, numFiles)
+	for i := range lens {
+		lens[i] = 16
+	}
+	info := &metainfo.Info{Name: "torrent"}
+	for i, l := range lens {
+		info.Files = append(info.Files, metainfo.FileInfo{
+			Length: l,
+			Path:   []string{"dir", fmt.Sprintf("file%d", i)},
+		})
+	}
+	fts, ci := newTestFileTorrent(b, info)
+	defer ci.Close()
+	defer fts.Close()
+
+	io_ := fileTorrentImplIO{fts}
+	buf := make([]byte, 16)
+	off := int64(numFiles/2) * 16
+	if _, err := io_.WriteAt(buf, off); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := io_.ReadAt(buf, off); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
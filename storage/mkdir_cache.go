@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"os"
+	"sync"
+)
+
+// mkdirCache memoizes directories that have already been created via
+// os.MkdirAll, so repeated writes into the same directory (common across
+// the many files of a multi-file torrent) skip the syscall.
+type mkdirCache struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newMkdirCache() *mkdirCache {
+	return &mkdirCache{seen: make(map[string]struct{})}
+}
+
+// ensure creates dir and its parents if this cache hasn't already done so.
+func (c *mkdirCache) ensure(dir string) error {
+	c.mu.Lock()
+	_, ok := c.seen[dir]
+	c.mu.Unlock()
+	if ok {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.seen[dir] = struct{}{}
+	c.mu.Unlock()
+	return nil
+}
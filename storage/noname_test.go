@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestNoNameMultiFile(t *testing.T) {
+	info := multiFileInfo(3, 5)
+	info.Name = metainfo.NoName
+	fts, ci := newTestFileTorrent(t, info)
+	defer ci.Close()
+	defer fts.Close()
+
+	for _, fi := range info.UpvertedFiles() {
+		name, err := fts.fileInfoName(fi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(name, metainfo.NoName) {
+			t.Errorf("path %q includes the NoName sentinel", name)
+		}
+		for _, p := range fi.Path {
+			if !strings.Contains(name, p) {
+				t.Errorf("path %q missing expected component %q", name, p)
+			}
+		}
+	}
+}
+
+func TestNoNameSingleFile(t *testing.T) {
+	// A single-file torrent's sole FileInfo has no Path of its own, so
+	// there's nothing left to name the file once Info.Name is stripped.
+	// OpenTorrent should reject this rather than silently resolving the
+	// file's path to the torrent's directory itself.
+	info := &metainfo.Info{Name: metainfo.NoName, Length: 4}
+	ci := NewFile(t.TempDir())
+	defer ci.Close()
+	if _, err := ci.OpenTorrent(info, metainfo.Hash{}); err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+}
+
+func TestNoNameZeroLengthFiles(t *testing.T) {
+	info := multiFileInfo(0, 0)
+	info.Name = metainfo.NoName
+	dir := t.TempDir()
+	if err := CreateNativeZeroLengthFiles(info, dir, nil, metainfo.Hash{}); err != nil {
+		t.Fatal(err)
+	}
+}
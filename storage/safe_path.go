@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ToSafeFilePath joins name and path into a single relative path, rejecting
+// any component that could cause the result to escape the directory it's
+// later joined to: "." or ".." segments, embedded path separators or NUL
+// bytes within a single component, or a component that is itself absolute
+// (including a Windows drive-letter path). A crafted .torrent can otherwise
+// use these to write outside the storage root.
+func ToSafeFilePath(name string, path ...string) (string, error) {
+	parts := append([]string{name}, path...)
+	clean := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p == "" {
+			continue
+		}
+		if p == "." || p == ".." {
+			return "", fmt.Errorf("unsafe path component %q", p)
+		}
+		if strings.ContainsRune(p, os.PathSeparator) || strings.ContainsRune(p, 0) {
+			return "", fmt.Errorf("unsafe path component %q", p)
+		}
+		// Reject the other platform's separator and drive-letter paths too,
+		// since a .torrent crafted on one OS can be opened on another.
+		if strings.ContainsAny(p, "/\\") {
+			return "", fmt.Errorf("unsafe path component %q", p)
+		}
+		if filepath.IsAbs(p) || isWindowsAbsPath(p) {
+			return "", fmt.Errorf("unsafe path component %q", p)
+		}
+		clean = append(clean, p)
+	}
+	joined := filepath.Join(clean...)
+	if filepath.IsAbs(joined) {
+		return "", fmt.Errorf("path %q escapes storage root", joined)
+	}
+	if joined == ".." || strings.HasPrefix(joined, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q escapes storage root", joined)
+	}
+	return joined, nil
+}
+
+// isWindowsAbsPath reports whether p looks like a Windows absolute path
+// (e.g. "C:\Windows" or "C:/Windows"), regardless of the host OS.
+func isWindowsAbsPath(p string) bool {
+	return len(p) >= 3 && p[1] == ':' && (p[2] == '\\' || p[2] == '/')
+}
+
+// validateRelPath checks a path already joined by a FilePathMaker (and so,
+// unlike ToSafeFilePath's component arguments, legitimately containing
+// internal separators) for escaping the directory it's about to be joined
+// under. A FilePathMaker is caller-supplied and can return anything,
+// including a relative path laced with "..": this is the same escape
+// ToSafeFilePath prevents for the default layout, applied after the fact to
+// a custom one.
+func validateRelPath(rel string) error {
+	if filepath.IsAbs(rel) || isWindowsAbsPath(rel) {
+		return fmt.Errorf("file path maker returned absolute path %q", rel)
+	}
+	clean := filepath.Clean(rel)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("file path maker returned path %q escaping the torrent directory", rel)
+	}
+	return nil
+}
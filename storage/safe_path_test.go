@@ -0,0 +1,37 @@
+package storage
+
+import "testing"
+
+func TestToSafeFilePath(t *testing.T) {
+	tests := []struct {
+		name string
+		path []string
+		want string
+		ok   bool
+	}{
+		{"normal-multi-file", []string{"dir", "sub", "file.txt"}, "normal-multi-file/dir/sub/file.txt", true},
+		{"normal-single-file", nil, "normal-single-file", true},
+		{"..", nil, "", false},
+		{"ok", []string{"..", "evil"}, "", false},
+		{"ok", []string{"..", "..", "evil"}, "", false},
+		{"ok", []string{"sub", "..", "..", "evil"}, "", false},
+		{"ok", []string{"/etc/passwd"}, "", false},
+		{"ok", []string{"C:\\Windows\\System32"}, "", false},
+		{"ok", []string{"C:/Windows/System32"}, "", false},
+		{"ok", []string{"a\x00b"}, "", false},
+	}
+	for i, tc := range tests {
+		got, err := ToSafeFilePath(tc.name, tc.path...)
+		if tc.ok {
+			if err != nil {
+				t.Errorf("case %d: unexpected error: %v", i, err)
+				continue
+			}
+			if got != tc.want {
+				t.Errorf("case %d: got %q, want %q", i, got, tc.want)
+			}
+		} else if err == nil {
+			t.Errorf("case %d: expected error for name=%q path=%v, got path %q", i, tc.name, tc.path, got)
+		}
+	}
+}